@@ -0,0 +1,13 @@
+package drivers
+
+// UserDataSetter is an optional interface that a Driver can implement to
+// support injecting provider-specific user data (e.g. cloud-init or
+// Ignition JSON) into an instance before it is created. Provisioners that
+// can configure a node declaratively at first boot should type-assert a
+// Driver against this interface and fall back to their normal post-boot
+// configuration flow when it isn't implemented.
+type UserDataSetter interface {
+	// SetUserData stores the given user data so that it is supplied to
+	// the instance at creation time. It must be called before Create.
+	SetUserData(userData []byte) error
+}
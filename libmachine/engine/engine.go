@@ -0,0 +1,36 @@
+package engine
+
+// Options represent the options that are used to configure the Docker
+// engine that provisioners install and configure on a host.
+type Options struct {
+	ArbitraryFlags   []string
+	Dns              []string
+	GraphDir         string
+	Env              []string
+	Ipv6             bool
+	InsecureRegistry []string
+	Labels           []string
+	LogLevel         string
+	StorageDriver    string
+	SelinuxEnabled   bool
+	TLSVerify        bool
+	RegistryMirror   []string
+	InstallURL       string
+
+	// InstallPackages lists additional OS packages that provisioners
+	// should layer onto the host alongside Docker (e.g. driver agents or
+	// monitoring tooling). Provisioners that only take effect after a
+	// reboot, such as rpm-ostree, should queue these and finalize them
+	// with a single reboot rather than one per package.
+	InstallPackages []string
+
+	// FCOSUpdateStrategy is the zincati update strategy (e.g. "immediate",
+	// "periodic" or "fleet_lock") Fedora CoreOS hosts are left with once
+	// provisioning completes. Defaults to "immediate" when empty.
+	FCOSUpdateStrategy string
+
+	// FCOSUpdateWindow is the zincati periodic update window (e.g.
+	// "Sat,Sun 04:00-06:00") applied when FCOSUpdateStrategy is
+	// "periodic". Ignored otherwise.
+	FCOSUpdateWindow string
+}
@@ -2,18 +2,34 @@ package provision
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/rancher/machine/libmachine/auth"
 	"github.com/rancher/machine/libmachine/drivers"
 	"github.com/rancher/machine/libmachine/engine"
 	"github.com/rancher/machine/libmachine/log"
+	"github.com/rancher/machine/libmachine/mcnutils"
+	"github.com/rancher/machine/libmachine/provision/ignition"
 	"github.com/rancher/machine/libmachine/provision/pkgaction"
 	"github.com/rancher/machine/libmachine/registry"
 	"github.com/rancher/machine/libmachine/swarm"
 )
 
+// dockerTLSPort is the port GenerateDockerOptions renders into the Docker
+// systemd drop-in, matching the port Docker Machine expects to dial over
+// TLS once provisioning is complete.
+const dockerTLSPort = 2376
+
 func init() {
 	Register("Fedora-CoreOS", &RegisteredProvisioner{
 		New: NewFedoraCoreOSProvisioner,
@@ -30,6 +46,10 @@ func NewFedoraCoreOSProvisioner(d drivers.Driver) Provisioner {
 // FedoraCoreOSProvisioner is a provisioner based on the CoreOS provisioner
 type FedoraCoreOSProvisioner struct {
 	SystemdProvisioner
+
+	// pendingReboot tracks whether Package has queued an rpm-ostree
+	// change that has not yet been applied with FinalizePackages.
+	pendingReboot bool
 }
 
 // String returns the name of the provisioner
@@ -96,6 +116,47 @@ Environment={{range .EngineOptions.Env}}{{ printf "%q" . }} {{end}}
 	}, nil
 }
 
+// WriteDockerOptionsIfChanged writes dockerOptions to the remote host and
+// restarts Docker only if the rendered content differs from what's already
+// there. Re-provisioning a node otherwise rewrites an identical drop-in and
+// bounces dockerd on every run, which can drop in-flight container
+// workloads for no reason. The returned bool reports whether anything was
+// written, for callers that want to log or act on whether a restart
+// happened.
+func (provisioner *FedoraCoreOSProvisioner) WriteDockerOptionsIfChanged(dockerOptions *DockerOptions) (bool, error) {
+	existing, _ := provisioner.SSHCommand(fmt.Sprintf("sudo cat %s 2>/dev/null", dockerOptions.EngineOptionsPath))
+	// SSHCommand trims trailing whitespace from its output, but the
+	// rendered drop-in always ends in a newline, so compare trimmed on
+	// both sides rather than letting that mismatch force a restart every
+	// single run.
+	if strings.TrimSpace(existing) == strings.TrimSpace(dockerOptions.EngineOptions) {
+		log.Debugf("%s is already up to date, skipping docker restart", dockerOptions.EngineOptionsPath)
+		return false, nil
+	}
+
+	log.Debugf("Writing %s", dockerOptions.EngineOptionsPath)
+	writeCmd := fmt.Sprintf("printf '%%s' %s | sudo tee %s", shellSingleQuote(dockerOptions.EngineOptions), dockerOptions.EngineOptionsPath)
+	if _, err := provisioner.SSHCommand(writeCmd); err != nil {
+		return false, err
+	}
+
+	if _, err := provisioner.SSHCommand("sudo systemctl daemon-reload"); err != nil {
+		return false, err
+	}
+
+	if _, err := provisioner.SSHCommand("sudo systemctl restart docker"); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// shellSingleQuote wraps s in single quotes for safe use as a single shell
+// argument, escaping any single quotes it contains.
+func shellSingleQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // CompatibleWithHost returns whether or not this provisoner is compatible
 // with the target host
 func (provisioner *FedoraCoreOSProvisioner) CompatibleWithHost() bool {
@@ -104,12 +165,166 @@ func (provisioner *FedoraCoreOSProvisioner) CompatibleWithHost() bool {
 	return isFedora && isCoreOS
 }
 
-// Package installs a package on the remote host. The Fedora CoreOS provisioner
-// does not support (or need) any package installation
+// Package layers or removes a package on the remote host via rpm-ostree.
+// rpm-ostree changes an immutable OS image and only take effect after a
+// reboot, so Package just queues the change; call FinalizePackages once
+// all of the desired changes have been made to reboot a single time.
 func (provisioner *FedoraCoreOSProvisioner) Package(name string, action pkgaction.PackageAction) error {
+	var command string
+
+	switch action {
+	case pkgaction.Install:
+		command = fmt.Sprintf("sudo rpm-ostree install -y %s", name)
+	case pkgaction.Remove:
+		command = fmt.Sprintf("sudo rpm-ostree uninstall -y %s", name)
+	case pkgaction.Upgrade:
+		command = "sudo rpm-ostree upgrade"
+	default:
+		return fmt.Errorf("fedoracoreos: unsupported package action %v", action)
+	}
+
+	if _, err := provisioner.SSHCommand(command); err != nil {
+		return err
+	}
+
+	provisioner.pendingReboot = true
+
 	return nil
 }
 
+// FinalizePackages reboots the host to apply any rpm-ostree changes queued
+// by Package, then waits for SSH to come back. It is a no-op if nothing is
+// pending.
+func (provisioner *FedoraCoreOSProvisioner) FinalizePackages() error {
+	if !provisioner.pendingReboot {
+		return nil
+	}
+
+	log.Debug("Rebooting to apply layered rpm-ostree packages")
+	if _, err := provisioner.SSHCommand("sudo systemctl reboot"); err != nil {
+		// systemctl reboot tears down the SSH session it's running
+		// over, so the command normally "fails" even when the reboot
+		// itself was issued fine. Log it and keep going rather than
+		// aborting provisioning over an expected disconnect.
+		log.Debugf("ignoring SSH error from reboot command: %s", err)
+	}
+
+	provisioner.pendingReboot = false
+
+	log.Debug("Waiting for SSH to go down for reboot")
+	if err := mcnutils.WaitFor(func() bool {
+		_, err := provisioner.SSHCommand("echo machine-rebooting")
+		return err != nil
+	}); err != nil {
+		return err
+	}
+
+	log.Debug("Waiting for SSH to come back up")
+	return provisioner.waitForSSH()
+}
+
+// waitForSSH blocks until the host accepts an SSH command, for callers that
+// need to wait out a reboot or a first boot before issuing further commands.
+func (provisioner *FedoraCoreOSProvisioner) waitForSSH() error {
+	return mcnutils.WaitFor(func() bool {
+		_, err := provisioner.SSHCommand("echo machine-ready")
+		return err == nil
+	})
+}
+
+// zincatiConfigPath is where zincati reads fragment overrides of its main
+// config from, highest-numbered file winning on conflicts.
+const zincatiConfigPath = "/etc/zincati/config.d/90-machine-provisioning.toml"
+
+// pauseZincatiConfig locks zincati so it can't reboot the node out from
+// under provisioning. "fleet_lock" requires a lock manager (base_url) that
+// isn't available here, so pausing instead uses the periodic strategy with
+// no window configured - there's never a window to update in, so zincati
+// never reboots the node.
+const pauseZincatiConfig = "[updates]\nstrategy = \"periodic\"\n\n[updates.periodic]\nwindow = []\n"
+
+// PauseAutoUpdates locks zincati so it won't reboot the node - and
+// potentially wipe out in-progress or freshly layered packages - while
+// Provision is running.
+func (provisioner *FedoraCoreOSProvisioner) PauseAutoUpdates() error {
+	return provisioner.writeZincatiConfig(pauseZincatiConfig)
+}
+
+// ResumeAutoUpdates restores zincati to the long-term update strategy
+// requested via EngineOptions once provisioning has finished. Callers such
+// as Rancher's rolling upgrade orchestration can also call PauseAutoUpdates
+// and ResumeAutoUpdates directly to bracket their own operations.
+func (provisioner *FedoraCoreOSProvisioner) ResumeAutoUpdates() error {
+	strategy := provisioner.EngineOptions.FCOSUpdateStrategy
+	if strategy == "" {
+		strategy = "immediate"
+	}
+
+	config := fmt.Sprintf("[updates]\nstrategy = %q\n", strategy)
+	if strategy == "periodic" && provisioner.EngineOptions.FCOSUpdateWindow != "" {
+		window, err := zincatiWindowTOML(provisioner.EngineOptions.FCOSUpdateWindow)
+		if err != nil {
+			return err
+		}
+		config += window
+	}
+
+	return provisioner.writeZincatiConfig(config)
+}
+
+// zincatiWindowTOML renders a "<days> <start>-<end>" window (e.g.
+// "Sat,Sun 04:00-06:00") as an [[updates.periodic.window]] array-of-tables
+// entry, the schema zincati expects.
+func zincatiWindowTOML(window string) (string, error) {
+	invalid := fmt.Errorf("invalid update window %q: expected \"<days> <start>-<end>\"", window)
+
+	fields := strings.Fields(window)
+	if len(fields) != 2 {
+		return "", invalid
+	}
+
+	days := strings.Split(fields[0], ",")
+	quotedDays := make([]string, len(days))
+	for i, day := range days {
+		quotedDays[i] = strconv.Quote(strings.TrimSpace(day))
+	}
+
+	bounds := strings.SplitN(fields[1], "-", 2)
+	if len(bounds) != 2 {
+		return "", invalid
+	}
+
+	start, err := time.Parse("15:04", bounds[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid update window start time %q: %w", bounds[0], err)
+	}
+
+	end, err := time.Parse("15:04", bounds[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid update window end time %q: %w", bounds[1], err)
+	}
+
+	lengthMinutes := int(end.Sub(start).Minutes())
+	if lengthMinutes <= 0 {
+		return "", fmt.Errorf("invalid update window %q: end time must be after start time", window)
+	}
+
+	return fmt.Sprintf(
+		"\n[[updates.periodic.window]]\ndays = [%s]\nstart_time = %q\nlength_minutes = %d\n",
+		strings.Join(quotedDays, ", "), bounds[0], lengthMinutes,
+	), nil
+}
+
+func (provisioner *FedoraCoreOSProvisioner) writeZincatiConfig(contents string) error {
+	writeCmd := fmt.Sprintf("printf '%%s' %s | sudo tee %s", shellSingleQuote(contents), zincatiConfigPath)
+	if _, err := provisioner.SSHCommand(writeCmd); err != nil {
+		return err
+	}
+
+	_, err := provisioner.SSHCommand("sudo systemctl restart zincati.service")
+	return err
+}
+
 // Provision provisions the machine
 func (provisioner *FedoraCoreOSProvisioner) Provision(swarmOptions swarm.Options, authOptions auth.Options, engineOptions engine.Options, registryOptions registry.Options) error {
 	provisioner.SwarmOptions = swarmOptions
@@ -117,28 +332,187 @@ func (provisioner *FedoraCoreOSProvisioner) Provision(swarmOptions swarm.Options
 	provisioner.EngineOptions = engineOptions
 	provisioner.RegistryOptions = registryOptions
 
-	if err := provisioner.SetHostname(provisioner.Driver.GetMachineName()); err != nil {
-		return err
+	provisioner.AuthOptions = setRemoteAuthOptions(provisioner)
+
+	// zincati gets paused below (directly over SSH, or baked into the
+	// Ignition config) before any state-changing step. Always try to
+	// restore the long-term strategy on the way out, even if
+	// provisioning fails partway through, so a failed run doesn't leave
+	// the node stuck without OS updates indefinitely.
+	defer func() {
+		log.Debug("Restoring zincati auto-update strategy")
+		if err := provisioner.ResumeAutoUpdates(); err != nil {
+			log.Errorf("failed to restore zincati auto-update strategy: %s", err)
+		}
+	}()
+
+	usesIgnition := false
+	if _, ok := provisioner.Driver.(drivers.UserDataSetter); ok {
+		log.Debug("Driver supports user data; hostname and zincati were already seeded via Ignition before Create")
+		usesIgnition = true
+
+		log.Debug("Waiting for the node's first boot to come up over SSH")
+		if err := provisioner.waitForSSH(); err != nil {
+			return err
+		}
+	} else {
+		log.Debug("Pausing zincati auto-updates for the duration of provisioning")
+		if err := provisioner.PauseAutoUpdates(); err != nil {
+			return err
+		}
+
+		if err := provisioner.SetHostname(provisioner.Driver.GetMachineName()); err != nil {
+			return err
+		}
 	}
 
 	if err := makeDockerOptionsDir(provisioner); err != nil {
 		return err
 	}
 
-	log.Debugf("Preparing certificates")
-	provisioner.AuthOptions = setRemoteAuthOptions(provisioner)
-
+	// TLS certs can only be generated once the node's IP is known, which
+	// isn't until after Create returns - so ConfigureAuth always runs
+	// here over SSH, even on the Ignition path. It also always runs
+	// regardless of whether the rendered drop-in below changed, since the
+	// drop-in only references the certs' remote paths, not their
+	// contents - a rotated cert wouldn't change the drop-in at all. Only
+	// the restart that follows the drop-in is conditional.
 	log.Debugf("Setting up certificates")
 	if err := ConfigureAuth(provisioner); err != nil {
 		return err
 	}
 
-	log.Debug("Logging into private registry")
-	if err := dockerLoginGeneric(provisioner, registryOptions); err != nil {
+	dockerOptions, err := provisioner.GenerateDockerOptions(dockerTLSPort)
+	if err != nil {
+		return err
+	}
+
+	if _, err := provisioner.WriteDockerOptionsIfChanged(dockerOptions); err != nil {
 		return err
 	}
 
+	if !usesIgnition {
+		log.Debug("Logging into private registry")
+		if err := dockerLoginGeneric(provisioner, registryOptions); err != nil {
+			return err
+		}
+	}
+
+	if len(provisioner.EngineOptions.InstallPackages) > 0 {
+		log.Debug("Layering additional packages with rpm-ostree")
+		for _, name := range provisioner.EngineOptions.InstallPackages {
+			if err := provisioner.Package(name, pkgaction.Install); err != nil {
+				return err
+			}
+		}
+
+		if err := provisioner.FinalizePackages(); err != nil {
+			return err
+		}
+	}
+
 	log.Debug("Configuring swarm")
-	err := configureSwarm(provisioner, swarmOptions, provisioner.AuthOptions)
-	return err
+	if err := configureSwarm(provisioner, swarmOptions, provisioner.AuthOptions); err != nil {
+		return err
+	}
+
+	log.Debug("Verifying Docker is reachable over TLS")
+	return provisioner.waitForDockerTLS()
+}
+
+// PrepareIgnitionUserData renders the first-boot Ignition config for a
+// Fedora CoreOS node - hostname, zincati pause state and (optionally)
+// registry credentials - and hands it to the driver via
+// UserDataSetter.SetUserData. It is a no-op if the driver doesn't implement
+// UserDataSetter.
+//
+// TLS certs are deliberately left out: the server cert's IP SAN can't be
+// generated until the node has an address, which Create doesn't allocate
+// until after this must have already run. Provision still uploads them and
+// configures the Docker drop-in over SSH once the node is up, exactly as it
+// does for drivers without UserDataSetter.
+//
+// It must be called before Driver.Create(): Ignition only applies at first
+// boot, while Provision doesn't run until after libmachine has already
+// created and booted the instance, which is too late for SetUserData to
+// have any effect. Host creation code should call this immediately before
+// Create() whenever the driver is expected to be Fedora CoreOS.
+func PrepareIgnitionUserData(d drivers.Driver, registryOptions registry.Options) error {
+	setter, ok := d.(drivers.UserDataSetter)
+	if !ok {
+		return nil
+	}
+
+	ignitionJSON, err := ignition.RenderIgnition(ignition.Params{
+		Hostname:         d.GetMachineName(),
+		RegistryAuthJSON: registryAuthJSON(registryOptions),
+		ZincatiConfig:    []byte(pauseZincatiConfig),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Setting user data on driver")
+	return setter.SetUserData(ignitionJSON)
+}
+
+// waitForDockerTLS blocks until Docker's TLS port is actually completing a
+// TLS handshake, with the server cert verified against the Docker Machine
+// CA, on the host's IP. Checking this directly, rather than relying on the
+// UserDataSetter type assertion or an SSH-side systemctl check, is the only
+// way to tell that provisioning - whichever path produced it - really left
+// the node in a state Docker Machine can talk to; a plain TCP dial would
+// pass even if dockerd came up without the cert ConfigureAuth just wrote.
+func (provisioner *FedoraCoreOSProvisioner) waitForDockerTLS() error {
+	ip, err := provisioner.Driver.GetIP()
+	if err != nil {
+		return err
+	}
+
+	caCert, err := os.ReadFile(provisioner.AuthOptions.CaCertPath)
+	if err != nil {
+		return err
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("fedoracoreos: failed to parse CA certificate at %s", provisioner.AuthOptions.CaCertPath)
+	}
+
+	addr := net.JoinHostPort(ip, strconv.Itoa(dockerTLSPort))
+	tlsConfig := &tls.Config{RootCAs: certPool}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	return mcnutils.WaitFor(func() bool {
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+}
+
+// registryAuthJSON builds the contents of a Docker config.json from
+// registryOptions, or nil if no private registry was configured.
+func registryAuthJSON(registryOptions registry.Options) []byte {
+	if registryOptions.Registry == "" {
+		return nil
+	}
+
+	basicAuth := base64.StdEncoding.EncodeToString([]byte(registryOptions.Username + ":" + registryOptions.Password))
+
+	data, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			registryOptions.Registry: map[string]string{
+				"auth": basicAuth,
+			},
+		},
+	})
+	if err != nil {
+		log.Errorf("failed to render registry auth config: %s", err)
+		return nil
+	}
+
+	return data
 }
@@ -0,0 +1,65 @@
+package provision
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/rancher/machine/libmachine/registry"
+)
+
+func TestRegistryAuthJSONNoRegistry(t *testing.T) {
+	if data := registryAuthJSON(registry.Options{}); data != nil {
+		t.Errorf("registryAuthJSON(%+v) = %s, want nil", registry.Options{}, data)
+	}
+}
+
+func TestRegistryAuthJSON(t *testing.T) {
+	registryOptions := registry.Options{
+		Registry: "registry.example.com",
+		Username: "user",
+		Password: "pass",
+	}
+
+	data := registryAuthJSON(registryOptions)
+	if data == nil {
+		t.Fatalf("registryAuthJSON(%+v) = nil, want config.json contents", registryOptions)
+	}
+
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("registryAuthJSON produced invalid JSON: %s", err)
+	}
+
+	entry, ok := config.Auths[registryOptions.Registry]
+	if !ok {
+		t.Fatalf("config.json has no entry for %q: %s", registryOptions.Registry, data)
+	}
+
+	wantAuth := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	if entry.Auth != wantAuth {
+		t.Errorf("auth = %q, want %q", entry.Auth, wantAuth)
+	}
+}
+
+func TestShellSingleQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", "''"},
+		{"plain", "'plain'"},
+		{"it's", `'it'\''s'`},
+		{"a'b'c", `'a'\''b'\''c'`},
+	}
+
+	for _, tt := range tests {
+		if got := shellSingleQuote(tt.in); got != tt.want {
+			t.Errorf("shellSingleQuote(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
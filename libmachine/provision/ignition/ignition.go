@@ -0,0 +1,101 @@
+// Package ignition renders minimal Ignition v3 configurations for
+// distributions (such as Fedora CoreOS) that are configured declaratively
+// at first boot rather than through post-boot SSH commands.
+package ignition
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// specVersion is the Ignition config spec version produced by RenderIgnition.
+const specVersion = "3.3.0"
+
+// Config is the root of an Ignition v3 configuration document.
+type Config struct {
+	Ignition Header   `json:"ignition"`
+	Storage  *Storage `json:"storage,omitempty"`
+}
+
+// Header carries the Ignition spec version.
+type Header struct {
+	Version string `json:"version"`
+}
+
+// Storage holds the files Ignition writes before first boot.
+type Storage struct {
+	Files []File `json:"files,omitempty"`
+}
+
+// File is a single file written by Ignition.
+type File struct {
+	Path      string       `json:"path"`
+	Mode      int          `json:"mode,omitempty"`
+	Overwrite bool         `json:"overwrite,omitempty"`
+	Contents  FileContents `json:"contents"`
+}
+
+// FileContents is an inline data URL carrying a file's contents.
+type FileContents struct {
+	Source string `json:"source"`
+}
+
+// Params holds the rendered content needed to build a first-boot Ignition
+// configuration for a Docker Machine host. TLS certificates and the Docker
+// drop-in aren't among them: the server cert's IP SAN, and therefore the
+// drop-in that references its remote path, aren't known until after
+// Driver.Create() allocates the node's address, so both are still set up
+// post-boot over SSH the same way the non-Ignition flow does it.
+type Params struct {
+	Hostname string
+
+	// RegistryAuthJSON, if non-empty, is written to
+	// /root/.docker/config.json so the node can pull from a private
+	// registry immediately on first boot.
+	RegistryAuthJSON []byte
+
+	// ZincatiConfig, if non-empty, is written to
+	// /etc/zincati/config.d/90-machine-provisioning.toml so zincati
+	// doesn't reboot the node out from under provisioning before it even
+	// finishes its first boot.
+	ZincatiConfig []byte
+}
+
+// RenderIgnition builds an Ignition v3 configuration that sets the
+// hostname and, if provided, seeds registry credentials and a zincati
+// pause config - whichever of those the caller already has available
+// before Create.
+func RenderIgnition(params Params) ([]byte, error) {
+	files := []File{
+		dataFile("/etc/hostname", 0644, []byte(params.Hostname+"\n")),
+	}
+
+	if len(params.RegistryAuthJSON) > 0 {
+		files = append(files, dataFile("/root/.docker/config.json", 0600, params.RegistryAuthJSON))
+	}
+
+	if len(params.ZincatiConfig) > 0 {
+		files = append(files, dataFile("/etc/zincati/config.d/90-machine-provisioning.toml", 0644, params.ZincatiConfig))
+	}
+
+	cfg := Config{
+		Ignition: Header{Version: specVersion},
+		Storage:  &Storage{Files: files},
+	}
+
+	return json.Marshal(cfg)
+}
+
+// dataFile builds an Ignition File whose contents are inlined as a base64
+// data URL, which is how Ignition embeds file content directly in the
+// config rather than fetching it from a remote source.
+func dataFile(path string, mode int, contents []byte) File {
+	return File{
+		Path:      path,
+		Mode:      mode,
+		Overwrite: true,
+		Contents: FileContents{
+			Source: "data:;base64," + base64.StdEncoding.EncodeToString(contents),
+		},
+	}
+}
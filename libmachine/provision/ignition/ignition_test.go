@@ -0,0 +1,72 @@
+package ignition
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func TestRenderIgnitionHostname(t *testing.T) {
+	data, err := RenderIgnition(Params{Hostname: "node-1"})
+	if err != nil {
+		t.Fatalf("RenderIgnition returned an error: %s", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("RenderIgnition produced invalid JSON: %s", err)
+	}
+
+	if cfg.Ignition.Version != specVersion {
+		t.Errorf("Ignition.Version = %q, want %q", cfg.Ignition.Version, specVersion)
+	}
+
+	if cfg.Storage == nil || len(cfg.Storage.Files) != 1 {
+		t.Fatalf("expected exactly one file with no optional params set, got %+v", cfg.Storage)
+	}
+
+	hostnameFile := cfg.Storage.Files[0]
+	if hostnameFile.Path != "/etc/hostname" {
+		t.Errorf("file path = %q, want /etc/hostname", hostnameFile.Path)
+	}
+
+	wantSource := "data:;base64," + base64.StdEncoding.EncodeToString([]byte("node-1\n"))
+	if hostnameFile.Contents.Source != wantSource {
+		t.Errorf("file contents = %q, want %q", hostnameFile.Contents.Source, wantSource)
+	}
+
+}
+
+func TestRenderIgnitionOptionalFields(t *testing.T) {
+	data, err := RenderIgnition(Params{
+		Hostname:         "node-1",
+		RegistryAuthJSON: []byte(`{"auths":{}}`),
+		ZincatiConfig:    []byte("[updates]\nstrategy = \"periodic\"\n"),
+	})
+	if err != nil {
+		t.Fatalf("RenderIgnition returned an error: %s", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("RenderIgnition produced invalid JSON: %s", err)
+	}
+
+	wantPaths := map[string]bool{
+		"/etc/hostname":             false,
+		"/root/.docker/config.json": false,
+		"/etc/zincati/config.d/90-machine-provisioning.toml": false,
+	}
+	for _, f := range cfg.Storage.Files {
+		if _, ok := wantPaths[f.Path]; !ok {
+			t.Errorf("unexpected file %q", f.Path)
+			continue
+		}
+		wantPaths[f.Path] = true
+	}
+	for path, seen := range wantPaths {
+		if !seen {
+			t.Errorf("expected a file at %q, found none", path)
+		}
+	}
+}